@@ -22,7 +22,7 @@ type foo struct {
 // 	hits          int
 // }
 
-func cacheKey(iter int) string {
+func benchKey(iter int) string {
 	bkt := int(float64(iter) / math.Log(float64(iter)))
 	rv := [16]byte{}
 	i := 0
@@ -37,7 +37,7 @@ func BenchmarkDirectMap(b *testing.B) {
 	cache := make(map[string]cacheEntry)
 	hits := make(map[string]int)
 	for n := 0; n < b.N; n++ {
-		k := cacheKey(n)
+		k := benchKey(n)
 		entry, hit := cache[k]
 		if hit {
 			hits[k]++
@@ -53,7 +53,7 @@ func BenchmarkPointerMap(b *testing.B) {
 	cache := make(map[string]*cacheEntry)
 	hits := make(map[string]int)
 	for n := 0; n < b.N; n++ {
-		k := cacheKey(n)
+		k := benchKey(n)
 		entry := cache[k]
 		if entry == nil {
 			entry = &cacheEntry{}
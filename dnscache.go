@@ -1,10 +1,15 @@
 package dnscache
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // DefaultResolverCount is the default number of resolvers used in a cache
@@ -13,39 +18,185 @@ const DefaultResolverCount int = 20
 // DefaultPurgeEvery is the default idle time of the purge process
 const DefaultPurgeEvery time.Duration = time.Minute
 
-// DefaultTTL is the default TTL of caches and can be overridden
+// DefaultTTL is the default TTL of caches and can be overridden. It also
+// serves as the default MaxTTL clamp.
 const DefaultTTL time.Duration = time.Hour
 
+// DefaultNegativeTTL is how long a failed or empty lookup (NXDOMAIN, timeout,
+// etc) is cached for. Kept short so a flaky upstream or a host that hasn't
+// registered PTR records yet doesn't get stuck for an hour.
+const DefaultNegativeTTL time.Duration = time.Second * 5
+
+// DefaultMinTTL is the default floor applied to the TTL reported by upstream,
+// so a misconfigured zero-TTL record doesn't cause a refresh storm.
+const DefaultMinTTL time.Duration = time.Second
+
 // CacheResolver User Interface
 type CacheResolver struct {
 	// Settings should not be changed after CacheResolver is started
 	Workers    int
 	PurgeEvery time.Duration
-	TTL        time.Duration
+
+	// TTL is the default for MaxTTL, the ceiling applied to a positive
+	// answer's authoritative TTL; it has no other effect, so an explicitly
+	// set MaxTTL takes its place. NegativeTTL is used instead
+	// for failed or empty lookups. MinTTL/MaxTTL clamp the authoritative
+	// TTL actually stored on the entry.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+
+	// Resolver is used for the forward LookupHost/LookupIPAddr queries
+	// (defaults to net.DefaultResolver). PTR (LookupAddr) queries still go
+	// through a dedicated miekg/dns exchange, so the per-record TTL can be
+	// captured, but that exchange dials through Resolver.Dial too when one
+	// is set; point it at a specific server, or swap in a stub (e.g. a
+	// net.Pipe-backed fake DNS responder), to control both lookup kinds in
+	// tests without touching live DNS.
+	Resolver *net.Resolver
+
+	// MaxEntries bounds the number of entries held in the cache. Once
+	// reached, inserting a new entry evicts the least-recently-used one
+	// (skipping past any entry currently refreshQueued/refreshInProgress).
+	// MaxEntries == 0 (the default) keeps the previous unbounded behavior.
+	MaxEntries int
+
+	// MaxQueueDepth bounds the number of lookups queued for a resolver
+	// worker. QueueFullPolicy decides what happens once it's reached.
+	// MaxQueueDepth == 0 (the default) keeps the previous unbounded queue.
+	MaxQueueDepth   int
+	QueueFullPolicy QueueFullPolicy
 
 	// Cache state
 	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
 
 	// Cache
 	lock  sync.RWMutex
-	cache map[string]*cacheEntry
+	cache map[cacheKey]*cacheEntry
 
-	requestChan  chan string // client -> queue
-	resolverChan chan string // queue -> resolver worker
+	// lruList/lruElem track recency for MaxEntries eviction. Front is most
+	// recently used. Unused (nil) when MaxEntries == 0.
+	lruList *list.List
+	lruElem map[cacheKey]*list.Element
+
+	requestChan  chan queueItem // client -> queue
+	resolverChan chan cacheKey  // queue -> resolver worker
+
+	// queueDepth mirrors the queue manager's current queue length so
+	// LookupAddr can make a Reject admission decision without a round trip
+	// through queueManager's select loop. Updated only by queueManager.
+	queueDepth int32
 
 	// Stats
 	queueSize         chan int // Queue manager sends the size of the queue
 	lastPurgeDuration time.Duration
+	lastQueueWait     time.Duration
 	hits              int
 	misses            int
+	evictions         int
+	drops             int
+
+	// metrics is nil unless RegisterMetrics was called before Start.
+	metrics *Metrics
+}
+
+// QueueFullPolicy controls what CacheResolver does with a new or in-flight
+// refresh request once the resolution queue is at MaxQueueDepth.
+type QueueFullPolicy uint8
+
+const (
+	// QueueFullBlock (the default) makes callers wait for queue space.
+	QueueFullBlock QueueFullPolicy = iota
+	// QueueFullDropNewest drops the incoming request.
+	QueueFullDropNewest
+	// QueueFullDropOldestRefresh evicts the oldest queued purger-originated
+	// refresh to make room, falling back to QueueFullDropNewest if the
+	// queue holds no refreshes to evict.
+	QueueFullDropOldestRefresh
+	// QueueFullReject fails the incoming LookupAddr/LookupHost/LookupIPAddr
+	// call with ErrQueueFull instead of queuing it.
+	QueueFullReject
+)
+
+// String returns the Prometheus label value used for this policy.
+func (p QueueFullPolicy) String() string {
+	switch p {
+	case QueueFullDropNewest:
+		return "drop_newest"
+	case QueueFullDropOldestRefresh:
+		return "drop_oldest_refresh"
+	case QueueFullReject:
+		return "reject"
+	default:
+		return "block"
+	}
+}
+
+// queueOrigin marks whether a queueItem was submitted by a caller (a cache
+// miss) or by cachePurger (a background refresh), so QueueFullDropOldestRefresh
+// can tell them apart.
+type queueOrigin uint8
+
+const (
+	originUser queueOrigin = iota
+	originRefresh
+)
+
+// queueItem is what's actually carried on requestChan: the key to resolve,
+// who asked for it, and when, so queueManager can report wait time and apply
+// QueueFullPolicy.
+type queueItem struct {
+	key      cacheKey
+	origin   queueOrigin
+	queuedAt time.Time
+
+	// admitted receives queueManager's accept/drop decision for this item,
+	// so the caller that optimistically inserted the cache entry knows
+	// whether to undo that insert. Only set for originUser items; cachePurger's
+	// originRefresh items leave it nil since a dropped refresh simply leaves
+	// the existing, already-settled entry for the next purge pass to retry.
+	admitted chan bool
+}
+
+// lookupOp identifies which kind of query a cacheKey/cacheEntry belongs to,
+// so a reverse lookup and a forward lookup for the same name don't collide.
+type lookupOp uint8
+
+const (
+	opLookupAddr lookupOp = iota
+	opLookupHost
+	opLookupIPAddr
+)
+
+// cacheKey is the cache/queue identity for a query: the operation plus the
+// name or address being resolved.
+type cacheKey struct {
+	op   lookupOp
+	name string
 }
 
 type cacheEntry struct {
-	names       []string
+	// names holds the result of opLookupAddr/opLookupHost; ips holds the
+	// result of opLookupIPAddr. Only one is populated, depending on the
+	// cacheKey.op this entry was stored under.
+	names []string
+	ips   []net.IPAddr
+
 	err         error
 	status      cacheEntryStatus
 	requests    int
 	lastRefresh time.Time
+	validUntil  time.Time
+
+	// waitChan is created when the entry is first queued for a refresh and
+	// closed by cacheResolver once the result fields have been updated and
+	// status flips back to nonePending. Callers blocked in
+	// LookupAddrContext snapshot this channel and select on it.
+	waitChan chan struct{}
 }
 
 type cacheEntryStatus uint8
@@ -62,6 +213,9 @@ type CacheStats struct {
 	Misses            int
 	QueueSize         int
 	CacheSize         int
+	Evictions         int
+	Drops             int
+	LastQueueWait     time.Duration
 	LastPurgeDuration time.Duration
 }
 
@@ -72,110 +226,444 @@ func (cr *CacheResolver) Start() {
 	if cr.TTL == time.Duration(0) {
 		cr.TTL = DefaultTTL
 	}
+	if cr.NegativeTTL == time.Duration(0) {
+		cr.NegativeTTL = DefaultNegativeTTL
+	}
+	if cr.MinTTL == time.Duration(0) {
+		cr.MinTTL = DefaultMinTTL
+	}
+	if cr.MaxTTL == time.Duration(0) {
+		cr.MaxTTL = cr.TTL
+	}
 	if cr.PurgeEvery == time.Duration(0) {
 		cr.PurgeEvery = DefaultPurgeEvery
 	}
 	if cr.Workers == 0 {
 		cr.Workers = DefaultResolverCount
 	}
+	if cr.Resolver == nil {
+		cr.Resolver = net.DefaultResolver
+	}
 
 	// Initialize fields
-	cr.cache = make(map[string]*cacheEntry)
+	cr.cache = make(map[cacheKey]*cacheEntry)
+	cr.lruList = list.New()
+	cr.lruElem = make(map[cacheKey]*list.Element)
 	cr.queueSize = make(chan int)
-	cr.requestChan = make(chan string)
-	cr.resolverChan = make(chan string)
+	cr.requestChan = make(chan queueItem)
+	cr.resolverChan = make(chan cacheKey)
+	cr.ctx, cr.cancel = context.WithCancel(context.Background())
 
 	// Start up GoRoutines
 	cr.started = true
-	go cr.queueManager()
-	go cr.cachePurger()
+	cr.wg.Add(2 + cr.Workers)
+	go func() {
+		defer cr.wg.Done()
+		cr.queueManager()
+	}()
+	go func() {
+		defer cr.wg.Done()
+		cr.cachePurger()
+	}()
 	for i := 0; i < cr.Workers; i++ {
-		go cr.cacheResolver()
+		go func() {
+			defer cr.wg.Done()
+			cr.cacheResolver()
+		}()
+	}
+}
+
+// Stop cancels the background goroutines (queueManager, cachePurger, and
+// each cacheResolver worker) and waits for them to exit, or for ctx to be
+// done, whichever comes first. Lookups issued after Stop are not supported.
+func (cr *CacheResolver) Stop(ctx context.Context) error {
+	cr.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		cr.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 // ErrLookupPending is a well known error for when the cache is pending being populated
 var ErrLookupPending error = fmt.Errorf("Lookup pending")
 
-// LookupAddr looks up addr in the cache and returns the cached results from net.LookupAddr including any error.
+// ErrQueueFull is returned by LookupAddr/LookupHost/LookupIPAddr for a new
+// lookup when QueueFullPolicy is QueueFullReject and the queue is already at
+// MaxQueueDepth. The cache entry is not created, so a later call retries.
+var ErrQueueFull error = fmt.Errorf("Lookup queue full")
+
+// ErrResolverStopped is returned by LookupAddr/LookupHost/LookupIPAddr/
+// LookupAddrContext when Stop is called while the lookup is still trying to
+// hand its key to queueManager (e.g. blocked behind MaxQueueDepth under
+// QueueFullBlock).
+var ErrResolverStopped error = fmt.Errorf("Resolver stopped")
+
+// LookupAddr looks up addr in the cache and returns the cached PTR results including any error.
 // If no entry exists in the cache then `nil, ErrLookupPending` is returned and a lookup is enqueued.
 func (cr *CacheResolver) LookupAddr(addr string) (names []string, err error) {
+	ent := cr.lookup(cacheKey{op: opLookupAddr, name: addr})
+	return ent.names, ent.err
+}
+
+// LookupHost looks up name's forward records in the cache and returns the cached
+// addresses from Resolver.LookupHost including any error.
+// If no entry exists in the cache then `nil, ErrLookupPending` is returned and a lookup is enqueued.
+func (cr *CacheResolver) LookupHost(name string) (addrs []string, err error) {
+	ent := cr.lookup(cacheKey{op: opLookupHost, name: name})
+	return ent.names, ent.err
+}
+
+// LookupIPAddr looks up name's forward records in the cache and returns the cached
+// addresses from Resolver.LookupIPAddr including any error.
+// If no entry exists in the cache then `nil, ErrLookupPending` is returned and a lookup is enqueued.
+func (cr *CacheResolver) LookupIPAddr(name string) (addrs []net.IPAddr, err error) {
+	ent := cr.lookup(cacheKey{op: opLookupIPAddr, name: name})
+	return ent.ips, ent.err
+}
+
+// lookup fetches key's entry, creating it and enqueueing a resolution if it
+// doesn't exist yet, and returns a copy of its result fields so the caller
+// can return without holding the cache lock. The requestChan send happens
+// after the lock is released so a full queue can't stall other callers.
+func (cr *CacheResolver) lookup(key cacheKey) cacheEntry {
 	cr.lock.Lock()
-	defer cr.lock.Unlock()
 
-	// Get cache entry
-	ent := cr.cache[addr]
-	if ent == nil {
+	ent := cr.cache[key]
+	isNew := ent == nil
+	if isNew {
+		if cr.queueAtCapacity() && cr.QueueFullPolicy == QueueFullReject {
+			cr.lock.Unlock()
+			cr.recordDrop(QueueFullReject)
+			return cacheEntry{err: ErrQueueFull}
+		}
+
 		// Create a new entry
 		ent = &cacheEntry{
-			status: refreshQueued,
-			err:    ErrLookupPending,
+			status:   refreshQueued,
+			err:      ErrLookupPending,
+			waitChan: make(chan struct{}),
 		}
-		cr.cache[addr] = ent
-
-		// Submit queue lookup
-		cr.requestChan <- addr
+		cr.cache[key] = ent
+		cr.touchLRU(key)
+		cr.evictLRULocked()
+	} else {
+		cr.touchLRU(key)
 	}
 
 	// Increment hit counters
 	if ent.status == nonePending {
 		cr.hits++
+		if cr.metrics != nil {
+			cr.metrics.hitsTotal.Inc()
+		}
 	} else {
 		cr.misses++
+		if cr.metrics != nil {
+			cr.metrics.missesTotal.Inc()
+		}
+	}
+
+	result := *ent
+	cr.lock.Unlock()
+
+	if isNew {
+		admitted := make(chan bool, 1)
+		select {
+		case cr.requestChan <- queueItem{key: key, origin: originUser, queuedAt: time.Now(), admitted: admitted}:
+		case <-cr.ctx.Done():
+			cr.dropPendingEntry(key)
+			return cacheEntry{err: ErrResolverStopped}
+		}
+		if !<-admitted {
+			cr.dropPendingEntry(key)
+			return cacheEntry{err: ErrQueueFull}
+		}
+	}
+
+	return result
+}
+
+// dropPendingEntry removes key's cache entry (and LRU bookkeeping) after a
+// newly-queued lookup never made it into queueManager's queue, either
+// because QueueFullDropNewest/QueueFullDropOldestRefresh dropped it or
+// because Stop cancelled the resolver first. Without this the entry would
+// sit in cr.cache forever as refreshQueued -- exempt from both cachePurger
+// and evictLRULocked -- so every future lookup for key would return
+// ErrLookupPending permanently. Also wakes any LookupAddrContext callers
+// parked on this entry's waitChan so they observe the drop instead of
+// blocking until their ctx deadline.
+func (cr *CacheResolver) dropPendingEntry(key cacheKey) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	ent := cr.cache[key]
+	if ent == nil || ent.status != refreshQueued {
+		return
+	}
+
+	delete(cr.cache, key)
+	if elem, ok := cr.lruElem[key]; ok {
+		cr.lruList.Remove(elem)
+		delete(cr.lruElem, key)
+	}
+	if ent.waitChan != nil {
+		close(ent.waitChan)
+		ent.waitChan = nil
+	}
+}
+
+// queueAtCapacity reports whether the resolution queue is currently at
+// MaxQueueDepth. MaxQueueDepth == 0 means unbounded, so it's never at
+// capacity.
+func (cr *CacheResolver) queueAtCapacity() bool {
+	return cr.MaxQueueDepth > 0 && int(atomic.LoadInt32(&cr.queueDepth)) >= cr.MaxQueueDepth
+}
+
+// recordDrop bumps the drop counter/metric for a request that QueueFullPolicy
+// prevented from being queued (or kept queued, for DropOldestRefresh).
+func (cr *CacheResolver) recordDrop(policy QueueFullPolicy) {
+	cr.lock.Lock()
+	cr.drops++
+	cr.lock.Unlock()
+	if cr.metrics != nil {
+		cr.metrics.queueDropsTotal.WithLabelValues(policy.String()).Inc()
+	}
+}
+
+// recordQueueWait records how long an item that just left the queue spent
+// waiting for a resolver worker.
+func (cr *CacheResolver) recordQueueWait(d time.Duration) {
+	cr.lock.Lock()
+	cr.lastQueueWait = d
+	cr.lock.Unlock()
+	if cr.metrics != nil {
+		cr.metrics.queueWaitSeconds.Observe(d.Seconds())
+	}
+}
+
+// LookupAddrContext looks up addr in the cache like LookupAddr, but instead
+// of returning ErrLookupPending on a miss or while a refresh is in flight, it
+// blocks the caller until the resolver worker finishes the lookup (or ctx is
+// done). On context cancellation it returns ctx.Err(). If ctx is done before
+// a new entry's key has been handed to the queue, that entry is removed
+// again; once the key is queued, cancellation leaves the cache untouched and
+// the in-flight resolution for other callers to observe.
+func (cr *CacheResolver) LookupAddrContext(ctx context.Context, addr string) ([]string, error) {
+	key := cacheKey{op: opLookupAddr, name: addr}
+
+	cr.lock.Lock()
+	ent := cr.cache[key]
+	wasPending := ent == nil || ent.status != nonePending
+	if ent == nil {
+		if cr.queueAtCapacity() && cr.QueueFullPolicy == QueueFullReject {
+			cr.lock.Unlock()
+			cr.recordDrop(QueueFullReject)
+			return nil, ErrQueueFull
+		}
+
+		// Create a new entry
+		ent = &cacheEntry{
+			status:   refreshQueued,
+			err:      ErrLookupPending,
+			waitChan: make(chan struct{}),
+		}
+		cr.cache[key] = ent
+		cr.touchLRU(key)
+		cr.evictLRULocked()
+		cr.lock.Unlock()
+
+		// Submit queue lookup
+		admitted := make(chan bool, 1)
+		select {
+		case cr.requestChan <- queueItem{key: key, origin: originUser, queuedAt: time.Now(), admitted: admitted}:
+		case <-ctx.Done():
+			cr.dropPendingEntry(key)
+			return nil, ctx.Err()
+		case <-cr.ctx.Done():
+			cr.dropPendingEntry(key)
+			return nil, ErrResolverStopped
+		}
+		if !<-admitted {
+			cr.dropPendingEntry(key)
+			return nil, ErrQueueFull
+		}
+	} else {
+		cr.touchLRU(key)
+		cr.lock.Unlock()
+	}
+
+	// Park until the entry settles, re-checking after every wake since the
+	// purger may re-queue a refresh before we observe nonePending.
+	for {
+		cr.lock.RLock()
+		status := ent.status
+		waitChan := ent.waitChan
+		cr.lock.RUnlock()
+
+		if status == nonePending || waitChan == nil {
+			break
+		}
+
+		select {
+		case <-waitChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if wasPending {
+		cr.misses++
+		if cr.metrics != nil {
+			cr.metrics.missesTotal.Inc()
+		}
+	} else {
+		cr.hits++
+		if cr.metrics != nil {
+			cr.metrics.hitsTotal.Inc()
+		}
+	}
 	return ent.names, ent.err
 }
 
 // CacheStats TODO
 func (cr *CacheResolver) CacheStats() CacheStats {
 	rv := CacheStats{}
-	rv.QueueSize = <-cr.queueSize
+	// queueManager stops servicing cr.queueSize once Stop cancels cr.ctx, so
+	// fall back to a zero QueueSize instead of blocking forever.
+	select {
+	case rv.QueueSize = <-cr.queueSize:
+	case <-cr.ctx.Done():
+	}
 	cr.lock.RLock()
 	defer cr.lock.RUnlock()
 	rv.Hits = cr.hits
 	rv.Misses = cr.misses
 	rv.LastPurgeDuration = cr.lastPurgeDuration
 	rv.CacheSize = len(cr.cache)
+	rv.Evictions = cr.evictions
+	rv.Drops = cr.drops
+	rv.LastQueueWait = cr.lastQueueWait
 	return rv
 }
 
 // Cache queue manager
 func (cr *CacheResolver) queueManager() {
-	queue := []string{}
+	queue := []queueItem{}
 
 	// Loop infinitely
 	for {
 		// rc will be left nil if we don't have anything to send
-		var rc chan string = nil
-		var nextItem string
+		var rc chan cacheKey = nil
+		var nextKey cacheKey
 		if len(queue) > 0 {
 			rc = cr.resolverChan
-			nextItem = queue[0]
+			nextKey = queue[0].key
+		}
+
+		// acceptChan is left nil (refusing new requests, so senders block)
+		// when the queue is full under QueueFullBlock. Every other policy
+		// keeps accepting so it can apply its drop logic below.
+		full := cr.MaxQueueDepth > 0 && len(queue) >= cr.MaxQueueDepth
+		acceptChan := cr.requestChan
+		if full && cr.QueueFullPolicy == QueueFullBlock {
+			acceptChan = nil
 		}
 
 		// Wait for next communication event
 		select {
+		case <-cr.ctx.Done(): // Stop requested
+			return
 		case cr.queueSize <- len(queue): // Request for queue size
-		case rc <- nextItem: // Worker requesting an item
+		case rc <- nextKey: // Worker requesting an item
+			cr.recordQueueWait(time.Since(queue[0].queuedAt))
 			queue = queue[1:]
-		case newReq := <-cr.requestChan: // New request inbound
-			queue = append(queue, newReq)
+		case newReq := <-acceptChan: // New request inbound
+			if !full {
+				queue = append(queue, newReq)
+				cr.replyAdmitted(newReq, true)
+			} else {
+				queue = cr.admitUnderPressure(queue, newReq)
+			}
+		}
+
+		atomic.StoreInt32(&cr.queueDepth, int32(len(queue)))
+		if cr.metrics != nil {
+			cr.metrics.queueDepth.Set(float64(len(queue)))
 		}
 	}
 }
 
+// admitUnderPressure applies QueueFullPolicy to newReq, which arrived while
+// the queue was already at MaxQueueDepth. QueueFullReject is usually caught
+// by the caller's queueAtCapacity check, but queueDepth can lag the queue,
+// so a request that slipped past that check is rejected here.
+func (cr *CacheResolver) admitUnderPressure(queue []queueItem, newReq queueItem) []queueItem {
+	switch cr.QueueFullPolicy {
+	case QueueFullDropOldestRefresh:
+		for i, item := range queue {
+			if item.origin == originRefresh {
+				queue = append(queue[:i], queue[i+1:]...)
+				queue = append(queue, newReq)
+				cr.recordDrop(QueueFullDropOldestRefresh)
+				cr.replyAdmitted(newReq, true)
+				return queue
+			}
+		}
+		// No refresh to evict: fall back to dropping the incoming request.
+		cr.recordDrop(QueueFullDropNewest)
+		cr.replyAdmitted(newReq, false)
+		return queue
+	case QueueFullDropNewest:
+		cr.recordDrop(QueueFullDropNewest)
+		cr.replyAdmitted(newReq, false)
+		return queue
+	case QueueFullReject:
+		cr.recordDrop(QueueFullReject)
+		cr.replyAdmitted(newReq, false)
+		return queue
+	default:
+		// QueueFullBlock: acceptChan is nil while full, so this case isn't
+		// reachable, but admit rather than silently drop if it ever is.
+		cr.replyAdmitted(newReq, true)
+		return append(queue, newReq)
+	}
+}
+
+// replyAdmitted tells the caller blocked in lookup/LookupAddrContext whether
+// its queueItem actually made it into the queue, so it knows whether to
+// unwind the cache entry it optimistically inserted. No-op for originRefresh
+// items, which don't carry a reply channel.
+func (cr *CacheResolver) replyAdmitted(item queueItem, admitted bool) {
+	if item.admitted != nil {
+		item.admitted <- admitted
+	}
+}
+
 // Cache expunger
 func (cr *CacheResolver) cachePurger() {
 	// Loop indefinitely
 	for {
-		// Wait for specified period of time
-		time.Sleep(cr.PurgeEvery)
+		// Wait for specified period of time, or a Stop request
+		select {
+		case <-time.After(cr.PurgeEvery):
+		case <-cr.ctx.Done():
+			return
+		}
 
 		purgeStart := time.Now()
-		purgeCutoff := purgeStart.Add(-cr.TTL)
-		cacheExpire := []string{}
-		cacheRefresh := []string{}
+		cacheExpire := []cacheKey{}
+		cacheRefresh := []cacheKey{}
 
 		// cacheLock scope
 		func() {
@@ -184,45 +672,67 @@ func (cr *CacheResolver) cachePurger() {
 
 			// Check status of each entry
 			//  Skip if the entry is pending a refresh in some respect
-			//  Skip if the entry is still OK
+			//  Skip if the entry is still within its TTL
 			//  Purge if the entry hasn't hit a certain request threshold
 			//  Refresh if the entry has hit a certain threshold
-			for addr, cacheEntry := range cr.cache {
-				if cacheEntry.status == nonePending && cacheEntry.lastRefresh.Before(purgeCutoff) {
+			for key, cacheEntry := range cr.cache {
+				if cacheEntry.status == nonePending && cacheEntry.validUntil.Before(purgeStart) {
 					if cacheEntry.requests > 1 {
-						cacheRefresh = append(cacheRefresh, addr)
+						cacheRefresh = append(cacheRefresh, key)
 					} else {
-						cacheExpire = append(cacheExpire, addr)
+						cacheExpire = append(cacheExpire, key)
 						cacheEntry.status = refreshQueued
 					}
 				}
 			}
 
 			// Expunge expired
-			for _, addr := range cacheExpire {
-				delete(cr.cache, addr)
+			for _, key := range cacheExpire {
+				delete(cr.cache, key)
+				if elem, ok := cr.lruElem[key]; ok {
+					cr.lruList.Remove(elem)
+					delete(cr.lruElem, key)
+				}
+			}
+
+			if cr.metrics != nil {
+				cr.metrics.cacheSize.Set(float64(len(cr.cache)))
 			}
 		}()
 
 		// Send in refresh request outside of the lock
-		for _, addr := range cacheRefresh {
-			cr.requestChan <- addr
+		for _, key := range cacheRefresh {
+			select {
+			case cr.requestChan <- queueItem{key: key, origin: originRefresh, queuedAt: time.Now()}:
+			case <-cr.ctx.Done():
+				return
+			}
 		}
 
 		// Update the purgeDuration
 		purgeEnd := time.Now()
+		purgeDuration := purgeEnd.Sub(purgeStart)
 		func() {
 			cr.lock.Lock()
 			defer cr.lock.Unlock()
-			cr.lastPurgeDuration = purgeEnd.Sub(purgeStart)
+			cr.lastPurgeDuration = purgeDuration
 		}()
+
+		if cr.metrics != nil {
+			cr.metrics.purgeDuration.Observe(purgeDuration.Seconds())
+		}
 	}
 }
 
 // Cache resolver goroutine
 func (cr *CacheResolver) cacheResolver() {
 	for {
-		addr := <-cr.resolverChan
+		var key cacheKey
+		select {
+		case key = <-cr.resolverChan:
+		case <-cr.ctx.Done():
+			return
+		}
 		skipLookup := true
 
 		// Check cache entry status, and update
@@ -231,10 +741,11 @@ func (cr *CacheResolver) cacheResolver() {
 			defer cr.lock.Unlock()
 
 			// Snag from cache
-			ent := cr.cache[addr]
+			ent := cr.cache[key]
 			if ent == nil {
 				ent = &cacheEntry{}
-				cr.cache[addr] = ent
+				cr.cache[key] = ent
+				cr.touchLRU(key)
 			}
 
 			// Check and update cacheEntry status
@@ -251,8 +762,16 @@ func (cr *CacheResolver) cacheResolver() {
 			continue
 		}
 
-		// Perform DNS lookup
-		names, err := net.LookupAddr(addr)
+		// Perform DNS lookup for whichever op this key is
+		lookupStart := time.Now()
+		names, ips, ttl, err := cr.resolve(key)
+
+		if cr.metrics != nil {
+			cr.metrics.lookupDuration.Observe(time.Since(lookupStart).Seconds())
+			if err != nil {
+				cr.metrics.lookupErrorsTotal.WithLabelValues(errorKind(err)).Inc()
+			}
+		}
 
 		// Update cache
 		func() {
@@ -260,18 +779,215 @@ func (cr *CacheResolver) cacheResolver() {
 			defer cr.lock.Unlock()
 
 			// Snag from cache
-			ent := cr.cache[addr]
+			ent := cr.cache[key]
 			if ent == nil {
 				ent = &cacheEntry{}
-				cr.cache[addr] = ent
+				cr.cache[key] = ent
+				cr.touchLRU(key)
 			}
 
 			// Update cache entry
+			now := time.Now()
 			ent.names = names
+			ent.ips = ips
 			ent.err = err
-			ent.lastRefresh = time.Now()
+			ent.lastRefresh = now
+			ent.validUntil = now.Add(ttl)
 			ent.status = nonePending
 			ent.requests = 0
+
+			// Wake any callers parked in LookupAddrContext
+			if ent.waitChan != nil {
+				close(ent.waitChan)
+				ent.waitChan = nil
+			}
 		}()
 	}
 }
+
+// errorKind classifies a lookup error for the dnscache_lookup_errors_total
+// metric label.
+func errorKind(err error) string {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		switch {
+		case dnsErr.IsNotFound:
+			return "nxdomain"
+		case dnsErr.IsTimeout:
+			return "timeout"
+		}
+	}
+	return "other"
+}
+
+// resolve dispatches key to the resolution function for its op.
+func (cr *CacheResolver) resolve(key cacheKey) (names []string, ips []net.IPAddr, ttl time.Duration, err error) {
+	switch key.op {
+	case opLookupAddr:
+		names, ttl, err = cr.resolvePTR(key.name)
+	case opLookupHost:
+		names, ttl, err = cr.resolveHost(key.name)
+	case opLookupIPAddr:
+		ips, ttl, err = cr.resolveIPAddr(key.name)
+	}
+	return
+}
+
+// resolveHost looks up name's forward records via Resolver. Since
+// net.Resolver doesn't surface per-record TTLs, successful answers are
+// cached for MaxTTL and failures for NegativeTTL.
+func (cr *CacheResolver) resolveHost(name string) (addrs []string, ttl time.Duration, err error) {
+	addrs, err = cr.Resolver.LookupHost(context.Background(), name)
+	if err != nil {
+		return nil, cr.NegativeTTL, err
+	}
+	return addrs, cr.MaxTTL, nil
+}
+
+// resolveIPAddr looks up name's forward records via Resolver, same TTL
+// handling as resolveHost.
+func (cr *CacheResolver) resolveIPAddr(name string) (addrs []net.IPAddr, ttl time.Duration, err error) {
+	addrs, err = cr.Resolver.LookupIPAddr(context.Background(), name)
+	if err != nil {
+		return nil, cr.NegativeTTL, err
+	}
+	return addrs, cr.MaxTTL, nil
+}
+
+// touchLRU marks key as most-recently-used. Caller must hold cr.lock. A
+// no-op when MaxEntries == 0.
+func (cr *CacheResolver) touchLRU(key cacheKey) {
+	if cr.MaxEntries <= 0 {
+		return
+	}
+	if elem, ok := cr.lruElem[key]; ok {
+		cr.lruList.MoveToFront(elem)
+		return
+	}
+	cr.lruElem[key] = cr.lruList.PushFront(key)
+}
+
+// evictLRULocked evicts the least-recently-used entry once the cache is over
+// MaxEntries, skipping past entries that are refreshQueued/refreshInProgress
+// since dropping those would orphan an in-flight resolution. Caller must
+// hold cr.lock. A no-op when MaxEntries == 0.
+func (cr *CacheResolver) evictLRULocked() {
+	if cr.MaxEntries <= 0 || len(cr.cache) <= cr.MaxEntries {
+		return
+	}
+
+	for elem := cr.lruList.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(cacheKey)
+		ent := cr.cache[key]
+		if ent != nil && (ent.status == refreshQueued || ent.status == refreshInProgress) {
+			continue
+		}
+
+		cr.lruList.Remove(elem)
+		delete(cr.lruElem, key)
+		if ent != nil {
+			delete(cr.cache, key)
+			cr.evictions++
+			if cr.metrics != nil {
+				cr.metrics.evictionsTotal.Inc()
+			}
+		}
+		return
+	}
+}
+
+// clampTTL applies the MinTTL/MaxTTL bounds configured on the CacheResolver.
+func (cr *CacheResolver) clampTTL(ttl time.Duration) time.Duration {
+	if cr.MinTTL > 0 && ttl < cr.MinTTL {
+		ttl = cr.MinTTL
+	}
+	if cr.MaxTTL > 0 && ttl > cr.MaxTTL {
+		ttl = cr.MaxTTL
+	}
+	return ttl
+}
+
+var (
+	resolvConfOnce sync.Once
+	resolvConf     *dns.ClientConfig
+)
+
+// systemClientConfig lazily loads /etc/resolv.conf, falling back to the
+// loopback resolver if it can't be read.
+func systemClientConfig() *dns.ClientConfig {
+	resolvConfOnce.Do(func() {
+		cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil || cfg == nil || len(cfg.Servers) == 0 {
+			cfg = &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: "53"}
+		}
+		resolvConf = cfg
+	})
+	return resolvConf
+}
+
+// dial opens a connection to a DNS server for resolvePTR, going through
+// cr.Resolver.Dial when one is set so callers can point PTR lookups at the
+// same custom server/stub as the forward lookups, and falling back to a
+// plain net.Dialer otherwise (net.DefaultResolver.Dial is nil).
+func (cr *CacheResolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if cr.Resolver != nil && cr.Resolver.Dial != nil {
+		return cr.Resolver.Dial(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// resolvePTR issues a PTR query for addr and returns the hostnames along
+// with the TTL to cache the result for: the minimum RR TTL from the answer
+// section on success (clamped to [MinTTL, MaxTTL]), or NegativeTTL on
+// NXDOMAIN, an empty answer, or a transport error.
+func (cr *CacheResolver) resolvePTR(addr string) (names []string, ttl time.Duration, err error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, cr.NegativeTTL, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(arpa, dns.TypePTR)
+	m.RecursionDesired = true
+
+	cfg := systemClientConfig()
+	server := net.JoinHostPort(cfg.Servers[0], cfg.Port)
+
+	ctx := context.Background()
+	conn, err := cr.dial(ctx, "udp", server)
+	if err != nil {
+		return nil, cr.NegativeTTL, err
+	}
+	defer conn.Close()
+
+	client := new(dns.Client)
+	resp, _, err := client.ExchangeWithConnContext(ctx, m, &dns.Conn{Conn: conn})
+	if err != nil {
+		return nil, cr.NegativeTTL, err
+	}
+
+	if resp.Rcode == dns.RcodeNameError {
+		return nil, cr.NegativeTTL, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, cr.NegativeTTL, &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: addr}
+	}
+
+	var minTTL uint32
+	for _, rr := range resp.Answer {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		names = append(names, ptr.Ptr)
+		if len(names) == 1 || rr.Header().Ttl < minTTL {
+			minTTL = rr.Header().Ttl
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, cr.NegativeTTL, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+
+	return names, cr.clampTTL(time.Duration(minTTL) * time.Second), nil
+}
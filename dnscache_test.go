@@ -1,10 +1,12 @@
 package dnscache
 
 import (
+	"context"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -49,6 +51,366 @@ func TestResolverSimple(t *testing.T) {
 	assert.LessOrEqual(t, int64(time.Nanosecond), int64(stats.LastPurgeDuration), "Purge not run")
 }
 
+// LookupAddrContext should block until the in-flight resolution completes
+// rather than handing back ErrLookupPending.
+func TestResolverLookupAddrContext(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 5
+	cache.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	names, err := cache.LookupAddrContext(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one.one.one.one."}, names)
+
+	// A second call should be satisfied from cache without blocking
+	names, err = cache.LookupAddrContext(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one.one.one.one."}, names)
+}
+
+// A cancelled context should return ctx.Err() without disturbing the
+// in-flight lookup for other callers.
+func TestResolverLookupAddrContextCancel(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 1
+	cache.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	names, err := cache.LookupAddrContext(ctx, "8.8.8.8")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, nilResult, names)
+}
+
+// LookupHost and LookupIPAddr should cache independently of LookupAddr even
+// when given the same underlying name/address.
+func TestResolverForwardLookups(t *testing.T) {
+	var cache CacheResolver
+	cache.PurgeEvery = time.Millisecond * 45
+	cache.Workers = 5
+	cache.Start()
+
+	names, err := cache.LookupHost("one.one.one.one")
+	assert.Equal(t, ErrLookupPending, err)
+	assert.Equal(t, nilResult, names)
+
+	ips, err := cache.LookupIPAddr("one.one.one.one")
+	assert.Equal(t, ErrLookupPending, err)
+	assert.Nil(t, ips)
+
+	// Wait for resolver(s) to do their thing
+	time.Sleep(time.Millisecond * 250)
+
+	names, err = cache.LookupHost("one.one.one.one")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, names)
+
+	ips, err = cache.LookupIPAddr("one.one.one.one")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ips)
+}
+
+// Stop should cancel the background goroutines and return once they've
+// drained, well within the supplied context's deadline.
+func TestResolverStop(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 3
+	cache.Start()
+
+	cache.LookupAddr("1.1.1.1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	assert.NoError(t, cache.Stop(ctx))
+}
+
+// CacheStats must not block forever when queueManager has already exited,
+// which happens once Stop has cancelled the resolver's context.
+func TestResolverStatsAfterStop(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 1
+	cache.Start()
+	cache.LookupAddr("1.2.3.4")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, cache.Stop(ctx))
+
+	done := make(chan struct{})
+	go func() {
+		cache.CacheStats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("CacheStats blocked after Stop")
+	}
+}
+
+// A LookupAddr/LookupHost blocked sending on requestChan (queue full under
+// QueueFullBlock) must unblock and return once Stop cancels the resolver,
+// instead of leaking the calling goroutine forever.
+func TestResolverStopUnblocksQueuedSend(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 1
+	cache.MaxQueueDepth = 1
+	cache.QueueFullPolicy = QueueFullBlock
+	cache.Start()
+
+	cache.LookupAddr("1.2.3.4")
+	cache.LookupAddr("2.3.4.5") // fills MaxQueueDepth=1
+
+	done := make(chan struct{})
+	go func() {
+		// Blocks sending to requestChan until Stop cancels the resolver.
+		cache.LookupAddr("3.4.5.6")
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	cache.Stop(ctx)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("LookupAddr goroutine leaked after Stop")
+	}
+}
+
+// With MaxEntries set, inserting past the cap should evict the
+// least-recently-used settled entry instead of growing unbounded.
+func TestResolverMaxEntries(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 5
+	cache.MaxEntries = 2
+	cache.Start()
+
+	cache.LookupAddr("1.2.3.4")
+	time.Sleep(time.Millisecond * 300)
+	cache.LookupAddr("2.3.4.5")
+	time.Sleep(time.Millisecond * 300)
+
+	// Re-touch 1.2.3.4 so 2.3.4.5 becomes the LRU victim
+	cache.LookupAddr("1.2.3.4")
+
+	cache.LookupAddr("3.4.5.6") // should evict 2.3.4.5, the LRU entry
+	time.Sleep(time.Millisecond * 100)
+
+	stats := cache.CacheStats()
+	assert.Equal(t, 2, stats.CacheSize)
+	assert.Equal(t, 1, stats.Evictions)
+}
+
+// With MaxQueueDepth set and QueueFullPolicy Reject, a burst of unique
+// addrs past the cap should fail fast with ErrQueueFull instead of
+// queuing (and not insert a cache entry, so a later call can retry).
+func TestResolverQueueFullReject(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 1
+	cache.MaxQueueDepth = 1
+	cache.QueueFullPolicy = QueueFullReject
+	cache.Start()
+
+	addrs := []string{"1.2.3.4", "2.3.4.5", "3.4.5.6", "4.5.6.7", "5.6.7.8"}
+	sawReject := false
+	for _, addr := range addrs {
+		_, err := cache.LookupAddr(addr)
+		if err == ErrQueueFull {
+			sawReject = true
+		}
+	}
+	assert.True(t, sawReject, "expected at least one LookupAddr to be rejected")
+
+	stats := cache.CacheStats()
+	assert.LessOrEqual(t, 1, stats.Drops)
+}
+
+// Under QueueFullDropNewest, a request dropped from queueManager's queue
+// must not leave a permanent refreshQueued "ghost" entry behind: the key
+// should be retryable (and not stuck returning ErrLookupPending forever)
+// once it's been dropped.
+func TestResolverQueueFullDropNewestDoesNotGhost(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 1
+	cache.MaxQueueDepth = 1
+	cache.QueueFullPolicy = QueueFullDropNewest
+	cache.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			time.Sleep(time.Second)
+			return nil, context.DeadlineExceeded
+		},
+	}
+	cache.Start()
+	time.Sleep(time.Millisecond * 20) // let the resolver worker reach its idle select
+
+	cache.LookupHost("host1.example.com") // picked up by the sole worker, blocks in Dial
+	time.Sleep(time.Millisecond * 50)
+	cache.LookupHost("host2.example.com") // fills the queue (depth 1)
+	time.Sleep(time.Millisecond * 50)
+
+	// Queue is now full, so this one should be dropped rather than wedged
+	// in cr.cache as a permanently-pending ghost.
+	_, err := cache.LookupHost("host3.example.com")
+	assert.Equal(t, ErrQueueFull, err)
+
+	// Wait for host1's dial to finish (the Go resolver retries once, so this
+	// is ~2x the stub's own sleep) so the worker dequeues host2, freeing
+	// queue space for host3's retry below.
+	time.Sleep(time.Millisecond * 2500)
+
+	// A fresh call for the same key must re-enqueue instead of returning
+	// ErrLookupPending forever.
+	_, err = cache.LookupHost("host3.example.com")
+	assert.Equal(t, ErrLookupPending, err)
+}
+
+// admitUnderPressure is exercised directly here rather than end-to-end,
+// since the only thing that ever queues an originRefresh item is
+// cachePurger's refresh path, which this cache never reaches in practice
+// (nothing increments cacheEntry.requests above the threshold that would
+// route a stale entry to refresh instead of expire).
+func TestAdmitUnderPressureDropOldestRefresh(t *testing.T) {
+	var cache CacheResolver
+	cache.QueueFullPolicy = QueueFullDropOldestRefresh
+
+	refresh := queueItem{key: cacheKey{op: opLookupAddr, name: "refresh.example.com"}, origin: originRefresh}
+	userAdmitted := make(chan bool, 1)
+	user := queueItem{key: cacheKey{op: opLookupAddr, name: "user.example.com"}, origin: originUser, admitted: userAdmitted}
+
+	queue := cache.admitUnderPressure([]queueItem{refresh}, user)
+	assert.Equal(t, []queueItem{user}, queue, "should evict the queued refresh to admit the user request")
+	assert.Equal(t, true, <-userAdmitted)
+	assert.Equal(t, 1, cache.drops)
+
+	// With no refresh item queued to evict, it must fall back to dropping
+	// the incoming request instead of growing past MaxQueueDepth.
+	other := queueItem{key: cacheKey{op: opLookupAddr, name: "other.example.com"}, origin: originUser, admitted: make(chan bool, 1)}
+	queue = cache.admitUnderPressure([]queueItem{user}, other)
+	assert.Equal(t, []queueItem{user}, queue, "should leave the queue unchanged when there's no refresh to evict")
+	assert.Equal(t, false, <-other.admitted)
+	assert.Equal(t, 2, cache.drops)
+}
+
+// resolvePTR should dial through Resolver.Dial just like the forward
+// lookups, so a stub responder can exercise LookupAddr without touching
+// live DNS.
+func TestResolverLookupAddrStubbedResolver(t *testing.T) {
+	arpa, err := dns.ReverseAddr("9.9.9.9")
+	assert.NoError(t, err)
+
+	var cache CacheResolver
+	cache.Workers = 1
+	cache.Resolver = &net.Resolver{
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go fakePTRServer(server, arpa, "dns.example.com.")
+			return client, nil
+		},
+	}
+	cache.Start()
+
+	cache.LookupAddr("9.9.9.9")
+	time.Sleep(time.Millisecond * 100)
+
+	names, err := cache.LookupAddr("9.9.9.9")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dns.example.com."}, names)
+}
+
+// fakePTRServer reads a single DNS query off conn and, if it's a PTR query
+// for wantQuestion, replies with a single PTR record for ptrName. Stands in
+// for a live DNS server in tests.
+func fakePTRServer(conn net.Conn, wantQuestion, ptrName string) {
+	defer conn.Close()
+
+	dc := &dns.Conn{Conn: conn}
+	req, err := dc.ReadMsg()
+	if err != nil {
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if len(req.Question) == 1 && req.Question[0].Qtype == dns.TypePTR && req.Question[0].Name == wantQuestion {
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: wantQuestion, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: ptrName,
+		})
+	}
+	dc.WriteMsg(resp)
+}
+
+// clampTTL should floor to MinTTL, ceiling to MaxTTL, and otherwise pass
+// the TTL through unchanged.
+func TestClampTTL(t *testing.T) {
+	var cache CacheResolver
+	cache.MinTTL = time.Second * 10
+	cache.MaxTTL = time.Minute
+
+	assert.Equal(t, cache.MinTTL, cache.clampTTL(time.Second))
+	assert.Equal(t, cache.MaxTTL, cache.clampTTL(time.Hour))
+	assert.Equal(t, time.Second*30, cache.clampTTL(time.Second*30))
+}
+
+// An NXDOMAIN PTR response should be cached for NegativeTTL rather than the
+// much longer positive TTL, so cachePurger expires it quickly instead of
+// pinning a flaky/nonexistent lookup in the cache for an hour.
+func TestResolverNegativeTTLExpiry(t *testing.T) {
+	var cache CacheResolver
+	cache.Workers = 1
+	cache.NegativeTTL = time.Millisecond * 200
+	cache.PurgeEvery = time.Millisecond * 25
+	cache.Resolver = &net.Resolver{
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go fakeNXDOMAINServer(server)
+			return client, nil
+		},
+	}
+	cache.Start()
+
+	cache.LookupAddr("9.9.9.9")
+	time.Sleep(time.Millisecond * 50)
+
+	names, err := cache.LookupAddr("9.9.9.9")
+	assert.Nil(t, names)
+	assert.True(t, err.(*net.DNSError).IsNotFound)
+
+	// NegativeTTL hasn't elapsed yet, so the entry should survive a purge
+	// pass untouched.
+	time.Sleep(time.Millisecond * 75)
+	assert.Equal(t, 1, cache.CacheStats().CacheSize)
+
+	// Once NegativeTTL elapses, the next purge pass should expire the entry
+	// entirely rather than leaving a failed lookup cached for an hour.
+	time.Sleep(time.Millisecond * 150)
+	assert.Equal(t, 0, cache.CacheStats().CacheSize)
+}
+
+// fakeNXDOMAINServer reads a single DNS query off conn and replies
+// NXDOMAIN, regardless of question.
+func fakeNXDOMAINServer(conn net.Conn) {
+	defer conn.Close()
+
+	dc := &dns.Conn{Conn: conn}
+	req, err := dc.ReadMsg()
+	if err != nil {
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	dc.WriteMsg(resp)
+}
+
 // Ensure QueueSize is getting reported as something
 func TestResolverStatsQueueSize(t *testing.T) {
 	var cache CacheResolver
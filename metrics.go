@@ -0,0 +1,93 @@
+package dnscache
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics holds the Prometheus collectors a CacheResolver reports through
+// once RegisterMetrics has been called. It is nil (and reporting is skipped)
+// until then.
+type Metrics struct {
+	hitsTotal         prometheus.Counter
+	missesTotal       prometheus.Counter
+	lookupErrorsTotal *prometheus.CounterVec
+	queueDepth        prometheus.Gauge
+	cacheSize         prometheus.Gauge
+	lookupDuration    prometheus.Histogram
+	purgeDuration     prometheus.Histogram
+	evictionsTotal    prometheus.Counter
+	queueDropsTotal   *prometheus.CounterVec
+	queueWaitSeconds  prometheus.Histogram
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		hitsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnscache_hits_total",
+			Help: "Total number of cache hits.",
+		}),
+		missesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnscache_misses_total",
+			Help: "Total number of cache misses.",
+		}),
+		lookupErrorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnscache_lookup_errors_total",
+			Help: "Total number of failed lookups, by kind (nxdomain, timeout, other).",
+		}, []string{"kind"}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnscache_queue_depth",
+			Help: "Current number of lookups queued for a resolver worker.",
+		}),
+		cacheSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnscache_cache_size",
+			Help: "Current number of entries held in the cache.",
+		}),
+		lookupDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dnscache_lookup_duration_seconds",
+			Help:    "Duration of upstream DNS lookups performed by resolver workers.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		purgeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dnscache_purge_duration_seconds",
+			Help:    "Duration of cachePurger passes.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		evictionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnscache_evictions_total",
+			Help: "Total number of entries evicted to stay within MaxEntries.",
+		}),
+		queueDropsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnscache_queue_drops_total",
+			Help: "Total number of lookup requests dropped or rejected due to MaxQueueDepth, by QueueFullPolicy.",
+		}, []string{"policy"}),
+		queueWaitSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dnscache_queue_wait_seconds",
+			Help:    "Time a lookup spent queued before a resolver worker picked it up.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
+// RegisterMetrics registers this CacheResolver's Prometheus collectors with
+// reg. Call it before Start; calling it after lookups are already flowing,
+// or more than once, is not supported.
+func (cr *CacheResolver) RegisterMetrics(reg prometheus.Registerer) error {
+	m := newMetrics()
+	collectors := []prometheus.Collector{
+		m.hitsTotal,
+		m.missesTotal,
+		m.lookupErrorsTotal,
+		m.queueDepth,
+		m.cacheSize,
+		m.lookupDuration,
+		m.purgeDuration,
+		m.evictionsTotal,
+		m.queueDropsTotal,
+		m.queueWaitSeconds,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	cr.metrics = m
+	return nil
+}